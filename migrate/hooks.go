@@ -0,0 +1,97 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Hook runs an action against a migration's connection, either before
+// or after the migration's own SQL. Hooks run directly against conn,
+// outside the migration's transaction, so they can perform actions
+// such as CREATE DATABASE that Postgres forbids inside a transaction
+// block.
+type Hook func(ctx context.Context, conn *pgx.Conn) error
+
+// CreateSchemaHook returns a Hook that creates schema name if it does
+// not already exist. This lets a single tern invocation bootstrap the
+// schemas a multi-schema deployment needs before migrating them.
+func CreateSchemaHook(name string) Hook {
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		ident := pgx.Identifier{name}.Sanitize()
+		_, err := conn.Exec(ctx, fmt.Sprintf("create schema if not exists %s", ident))
+		return err
+	}
+}
+
+// CreateDatabaseHook returns a Hook that creates database name if it
+// does not already exist.
+func CreateDatabaseHook(name string) Hook {
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		var exists bool
+		err := conn.QueryRow(ctx, "select exists(select 1 from pg_database where datname=$1)", name).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+
+		ident := pgx.Identifier{name}.Sanitize()
+		_, err = conn.Exec(ctx, fmt.Sprintf("create database %s", ident))
+		return err
+	}
+}
+
+// hookDirectivePattern matches a "-- tern:pre: fn arg" or
+// "-- tern:post: fn arg" comment line declaring a Hook.
+var hookDirectivePattern = regexp.MustCompile(`(?m)^-- tern:(pre|post):\s*(\S+)\s+(\S+)\s*$`)
+
+// extractHookDirectives removes tern:pre/tern:post directive comments
+// from sql, returning the remaining SQL along with the Hooks they
+// declared.
+func extractHookDirectives(sql string) (cleaned string, preHooks, postHooks []Hook, err error) {
+	matches := hookDirectivePattern.FindAllStringSubmatchIndex(sql, -1)
+	if matches == nil {
+		return sql, nil, nil, nil
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, match := range matches {
+		b.WriteString(sql[last:match[0]])
+		last = match[1]
+
+		phase := sql[match[2]:match[3]]
+		fn := sql[match[4]:match[5]]
+		arg := sql[match[6]:match[7]]
+
+		hook, err := hookDirectiveFunc(fn, arg)
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		if phase == "pre" {
+			preHooks = append(preHooks, hook)
+		} else {
+			postHooks = append(postHooks, hook)
+		}
+	}
+	b.WriteString(sql[last:])
+
+	return b.String(), preHooks, postHooks, nil
+}
+
+func hookDirectiveFunc(fn, arg string) (Hook, error) {
+	switch fn {
+	case "create_schema":
+		return CreateSchemaHook(arg), nil
+	case "create_database":
+		return CreateDatabaseHook(arg), nil
+	default:
+		return nil, fmt.Errorf("unknown tern hook directive: %s", fn)
+	}
+}
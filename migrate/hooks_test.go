@@ -0,0 +1,37 @@
+package migrate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractHookDirectives(t *testing.T) {
+	sql := "-- tern:pre: create_schema foo\n" +
+		"-- tern:post: create_database bar\n" +
+		"create table foo.t1(id serial primary key);"
+
+	cleaned, preHooks, postHooks, err := extractHookDirectives(sql)
+	require.NoError(t, err)
+	assert.Equal(t, "\n\ncreate table foo.t1(id serial primary key);", cleaned)
+	assert.Len(t, preHooks, 1)
+	assert.Len(t, postHooks, 1)
+}
+
+func TestExtractHookDirectivesNoDirectives(t *testing.T) {
+	sql := "create table t1(id serial primary key);"
+
+	cleaned, preHooks, postHooks, err := extractHookDirectives(sql)
+	require.NoError(t, err)
+	assert.Equal(t, sql, cleaned)
+	assert.Empty(t, preHooks)
+	assert.Empty(t, postHooks)
+}
+
+func TestExtractHookDirectivesUnknownFunc(t *testing.T) {
+	sql := "-- tern:pre: drop_everything foo\ncreate table t1(id serial primary key);"
+
+	_, _, _, err := extractHookDirectives(sql)
+	require.EqualError(t, err, "unknown tern hook directive: drop_everything")
+}
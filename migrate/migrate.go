@@ -0,0 +1,553 @@
+// Package migrate provides a simple schema migration system for a
+// single Postgres database.
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/jackc/pgx/v4"
+)
+
+// advisoryLockPollInterval is how often MigrateTo retries acquiring the
+// advisory lock while MigratorOptions.LockTimeout is in effect.
+const advisoryLockPollInterval = 100 * time.Millisecond
+
+var migrationPattern = regexp.MustCompile(`\A(\d+)_.+\.sql\z`)
+var migrationDividerPattern = regexp.MustCompile(`(?m)^---- create above / drop below ----\s*$`)
+
+// ErrNoFwMigration occurs when a migration file has no forward (up) SQL.
+var ErrNoFwMigration = errors.New("no sql in forward direction")
+
+// ErrIrreversibleMigration occurs when a rollback is requested through a
+// migration that has no down SQL.
+var ErrIrreversibleMigration = errors.New("irreversible migration")
+
+// ErrMigrationLocked occurs when MigratorOptions.LockTimeout elapses
+// while waiting for another process to release the migration advisory
+// lock.
+var ErrMigrationLocked = errors.New("timed out waiting for migration lock")
+
+// NoMigrationsFoundError occurs when a migration directory contains no
+// migration files.
+type NoMigrationsFoundError struct {
+	Path string
+}
+
+func (e NoMigrationsFoundError) Error() string {
+	return fmt.Sprintf("No migrations found at %s", e.Path)
+}
+
+// Migration represents a single, numbered schema migration.
+type Migration struct {
+	Sequence int32
+	Name     string
+	SQL      string
+	DownSQL  string
+
+	// PreHooks run, in order, before SQL. PostHooks run, in order,
+	// after it. Both run directly against the connection, outside the
+	// migration's own transaction.
+	PreHooks  []Hook
+	PostHooks []Hook
+}
+
+// MigratorOptions controls the behavior of a Migrator.
+type MigratorOptions struct {
+	// DisableTx disables running each migration inside its own
+	// transaction. This is required for statements that cannot run
+	// inside a transaction block, such as CREATE INDEX CONCURRENTLY.
+	DisableTx bool
+
+	// LockTimeout bounds how long Migrate/MigrateTo will wait to
+	// acquire the version table's advisory lock before giving up with
+	// ErrMigrationLocked. Zero, the default, waits indefinitely.
+	LockTimeout time.Duration
+
+	// DryRun causes Migrate/MigrateTo to render and, unless DisableTx
+	// is also set, execute each migration inside a transaction that is
+	// always rolled back instead of committed. When DisableTx is set,
+	// execution is skipped entirely. Either way OnStart still fires and
+	// the version table is left untouched, so operators can preview
+	// what a migration run would do.
+	DryRun bool
+}
+
+// Migrator manages migrations for a single Postgres database.
+type Migrator struct {
+	Migrations []*Migration
+	OnStart    func(sequence int32, name, sql string)
+	Data       map[string]interface{}
+
+	// SnapshotDir, when non-empty, causes MigrateTo to write a
+	// DumpSchema snapshot to SnapshotDir/NNN.sql after each migration
+	// step and enables VerifySnapshot to check the live schema against
+	// those stored snapshots.
+	SnapshotDir string
+
+	conn         *pgx.Conn
+	versionTable string
+	options      *MigratorOptions
+}
+
+// NewMigrator creates a new Migrator backed by conn, creating
+// versionTable if it does not already exist.
+func NewMigrator(ctx context.Context, conn *pgx.Conn, versionTable string) (m *Migrator, err error) {
+	return NewMigratorEx(ctx, conn, versionTable, &MigratorOptions{})
+}
+
+// NewMigratorEx is like NewMigrator but allows customizing the
+// Migrator's behavior via opts.
+func NewMigratorEx(ctx context.Context, conn *pgx.Conn, versionTable string, opts *MigratorOptions) (m *Migrator, err error) {
+	m = &Migrator{conn: conn, versionTable: versionTable, options: opts}
+	err = m.ensureSchemaVersionTableExists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.Migrations = make([]*Migration, 0)
+	return m, nil
+}
+
+// AppendMigration appends a migration with the given name and forward
+// SQL to m.Migrations. The migration has no down SQL and cannot be
+// rolled back.
+func (m *Migrator) AppendMigration(name, upSQL string) {
+	m.AppendMigrationEx(name, upSQL, "")
+}
+
+// AppendMigrationEx appends a migration with the given name, forward
+// (up) SQL, and reverse (down) SQL to m.Migrations. If downSQL is
+// empty, the migration is irreversible.
+func (m *Migrator) AppendMigrationEx(name, upSQL, downSQL string) {
+	m.Migrations = append(m.Migrations, &Migration{
+		Sequence: int32(len(m.Migrations)) + 1,
+		Name:     name,
+		SQL:      upSQL,
+		DownSQL:  downSQL,
+	})
+}
+
+// FindMigrations returns the sorted list of migration file names found
+// in path, erroring if the sequence numbers embedded in the file names
+// have a gap or a duplicate.
+func FindMigrations(path string) ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(fileInfos))
+	for _, fi := range fileInfos {
+		if fi.IsDir() {
+			continue
+		}
+
+		matches := migrationPattern.FindStringSubmatch(fi.Name())
+		if len(matches) != 2 {
+			continue
+		}
+
+		n, err := strconv.ParseInt(matches[1], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < int64(len(paths))+1 {
+			return nil, fmt.Errorf("Duplicate migration %d", n)
+		} else if n > int64(len(paths))+1 {
+			return nil, fmt.Errorf("Missing migration %d", len(paths)+1)
+		}
+
+		paths = append(paths, fi.Name())
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// errNoMigrationsFound is returned by LoadSource when the source has no
+// migrations. LoadMigrations translates it into a NoMigrationsFoundError
+// carrying the directory path.
+var errNoMigrationsFound = errors.New("no migrations found")
+
+// LoadMigrations loads all migrations found in path into m.Migrations.
+func (m *Migrator) LoadMigrations(path string) error {
+	path = strings.TrimRight(path, string(filepath.Separator))
+
+	err := m.LoadSource(context.Background(), DirSource(path))
+	if err == errNoMigrationsFound {
+		return NoMigrationsFoundError{Path: path}
+	}
+	return err
+}
+
+// LoadSource loads all migrations supplied by source into m.Migrations.
+// This allows migrations to come from something other than a directory
+// on disk, such as an embed.FS. Each migration's up and down SQL is
+// rendered through m.Data as it is loaded.
+func (m *Migrator) LoadSource(ctx context.Context, source Source) error {
+	versions, err := source.List()
+	if err != nil {
+		return err
+	}
+
+	if len(versions) == 0 {
+		return errNoMigrationsFound
+	}
+
+	for _, version := range versions {
+		name, upSQL, downSQL, err := source.Open(version)
+		if err != nil {
+			return err
+		}
+
+		upSQL, preHooks, postHooks, err := extractHookDirectives(upSQL)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		upSQL = strings.TrimSpace(upSQL)
+
+		if upSQL == "" {
+			return ErrNoFwMigration
+		}
+
+		upSQL, err = m.evalMigration(upSQL)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		downSQL, err = m.evalMigration(downSQL)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		m.Migrations = append(m.Migrations, &Migration{
+			Sequence:  int32(len(m.Migrations)) + 1,
+			Name:      name,
+			SQL:       upSQL,
+			DownSQL:   downSQL,
+			PreHooks:  preHooks,
+			PostHooks: postHooks,
+		})
+	}
+
+	return nil
+}
+
+// splitMigrationSQL splits a migration file's contents on the
+// "---- create above / drop below ----" divider, returning the up and
+// down SQL. If the divider is not present, down is empty.
+func splitMigrationSQL(contents string) (up, down string) {
+	parts := migrationDividerPattern.Split(contents, 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// GetCurrentVersion returns the currently applied migration version.
+func (m *Migrator) GetCurrentVersion(ctx context.Context) (int32, error) {
+	var v int32
+	err := m.conn.QueryRow(ctx, "select version from "+m.versionTable).Scan(&v)
+	return v, err
+}
+
+// Migrate runs all unapplied migrations in sequence.
+func (m *Migrator) Migrate(ctx context.Context) error {
+	return m.MigrateTo(ctx, int32(len(m.Migrations)))
+}
+
+// MigrateTo migrates to targetVersion, running forward migrations in
+// order, or, when targetVersion is below the current version, the down
+// SQL of the applied migrations in reverse order. It holds a Postgres advisory lock scoped to the version table
+// for the duration of the migration so that concurrently started tern
+// processes serialize instead of racing on the version table.
+func (m *Migrator) MigrateTo(ctx context.Context, targetVersion int32) error {
+	if err := m.acquireAdvisoryLock(ctx); err != nil {
+		return err
+	}
+	defer m.releaseAdvisoryLock(ctx)
+
+	currentVersion, err := m.GetCurrentVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	if int32(len(m.Migrations)) < currentVersion {
+		return fmt.Errorf("current version %d is greater than last version of %d", currentVersion, len(m.Migrations))
+	}
+
+	if targetVersion < 0 || int32(len(m.Migrations)) < targetVersion {
+		return fmt.Errorf("destination version %d is outside the valid versions of 0 to %d", targetVersion, len(m.Migrations))
+	}
+
+	for currentVersion < targetVersion {
+		current := m.Migrations[currentVersion]
+		if err := m.runMigration(ctx, current, current.SQL, currentVersion+1, DirectionUp); err != nil {
+			return err
+		}
+		currentVersion++
+	}
+
+	for currentVersion > targetVersion {
+		current := m.Migrations[currentVersion-1]
+		if current.DownSQL == "" {
+			return ErrIrreversibleMigration
+		}
+		if err := m.runMigration(ctx, current, current.DownSQL, currentVersion-1, DirectionDown); err != nil {
+			return err
+		}
+		currentVersion--
+	}
+
+	return nil
+}
+
+// Direction identifies whether a PlannedStep applies a migration's up
+// or down SQL.
+type Direction string
+
+// The two directions a PlannedStep can run in.
+const (
+	DirectionUp   Direction = "up"
+	DirectionDown Direction = "down"
+)
+
+// PlannedStep is one migration Plan would run, with its SQL already
+// rendered through the Migrator's template Data.
+type PlannedStep struct {
+	Version   int32
+	Name      string
+	Direction Direction
+	SQL       string
+}
+
+// Plan returns the ordered list of steps MigrateTo(ctx, targetVersion)
+// would run, without executing anything. It's the basis for a
+// dry-run/preview workflow: pipe the SQL through psql for review before
+// actually migrating.
+func (m *Migrator) Plan(ctx context.Context, targetVersion int32) ([]PlannedStep, error) {
+	currentVersion, err := m.GetCurrentVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if int32(len(m.Migrations)) < currentVersion {
+		return nil, fmt.Errorf("current version %d is greater than last version of %d", currentVersion, len(m.Migrations))
+	}
+
+	if targetVersion < 0 || int32(len(m.Migrations)) < targetVersion {
+		return nil, fmt.Errorf("destination version %d is outside the valid versions of 0 to %d", targetVersion, len(m.Migrations))
+	}
+
+	var steps []PlannedStep
+
+	for v := currentVersion; v < targetVersion; v++ {
+		current := m.Migrations[v]
+		sql, err := m.evalMigration(current.SQL)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, PlannedStep{Version: v + 1, Name: current.Name, Direction: DirectionUp, SQL: sql})
+	}
+
+	for v := currentVersion; v > targetVersion; v-- {
+		current := m.Migrations[v-1]
+		if current.DownSQL == "" {
+			return nil, ErrIrreversibleMigration
+		}
+		sql, err := m.evalMigration(current.DownSQL)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, PlannedStep{Version: v - 1, Name: current.Name, Direction: DirectionDown, SQL: sql})
+	}
+
+	return steps, nil
+}
+
+// RenderSQL returns the up SQL for the migration at version, rendered
+// through the Migrator's template Data, without executing it.
+func (m *Migrator) RenderSQL(version int32) (string, error) {
+	if version < 1 || int32(len(m.Migrations)) < version {
+		return "", fmt.Errorf("no migration with version %d", version)
+	}
+	return m.evalMigration(m.Migrations[version-1].SQL)
+}
+
+func (m *Migrator) runMigration(ctx context.Context, current *Migration, rawSQL string, newVersion int32, direction Direction) error {
+	sql, err := m.evalMigration(rawSQL)
+	if err != nil {
+		return err
+	}
+
+	if m.OnStart != nil {
+		m.OnStart(current.Sequence, current.Name, sql)
+	}
+
+	// Hooks run directly against the connection, outside the
+	// migration's own transaction, since actions like CreateDatabaseHook
+	// cannot run inside a transaction block at all. They have no
+	// transactional undo, so DryRun skips them entirely rather than
+	// letting them run for real during a preview. They also only apply
+	// when running up: they were parsed from the up SQL to prepare for
+	// it, and re-running them in front of the down SQL while rolling
+	// back would be backwards.
+	runHooks := direction == DirectionUp && !m.options.DryRun
+
+	if runHooks {
+		for _, hook := range current.PreHooks {
+			if err := hook(ctx, m.conn); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := m.execMigration(ctx, sql, newVersion); err != nil {
+		return err
+	}
+
+	if runHooks {
+		for _, hook := range current.PostHooks {
+			if err := hook(ctx, m.conn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) execMigration(ctx context.Context, sql string, newVersion int32) error {
+	if m.options.DisableTx {
+		if m.options.DryRun {
+			return nil
+		}
+		if _, err := m.conn.Exec(ctx, sql); err != nil {
+			return err
+		}
+		if _, err := m.conn.Exec(ctx, fmt.Sprintf("update %s set version=%d", m.versionTable, newVersion)); err != nil {
+			return err
+		}
+		return m.writeSnapshot(ctx, newVersion)
+	}
+
+	tx, err := m.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf("update %s set version=%d", m.versionTable, newVersion)); err != nil {
+		return err
+	}
+
+	if m.options.DryRun {
+		// The deferred Rollback above discards these changes.
+		return nil
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	return m.writeSnapshot(ctx, newVersion)
+}
+
+func (m *Migrator) evalMigration(sql string) (string, error) {
+	tmpl, err := template.New("migration").Funcs(sprig.TxtFuncMap()).Parse(sql)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, m.Data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// advisoryLockKey derives a stable int64 lock key from the version
+// table name so that migrators for different version tables don't
+// contend with one another.
+func (m *Migrator) advisoryLockKey() int64 {
+	h := fnv.New64a()
+	h.Write([]byte(m.versionTable))
+	return int64(h.Sum64())
+}
+
+func (m *Migrator) acquireAdvisoryLock(ctx context.Context) error {
+	key := m.advisoryLockKey()
+
+	if m.options.LockTimeout <= 0 {
+		_, err := m.conn.Exec(ctx, "select pg_advisory_lock($1)", key)
+		return err
+	}
+
+	deadline := time.Now().Add(m.options.LockTimeout)
+	for {
+		var acquired bool
+		if err := m.conn.QueryRow(ctx, "select pg_try_advisory_lock($1)", key).Scan(&acquired); err != nil {
+			return err
+		}
+		if acquired {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return ErrMigrationLocked
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(advisoryLockPollInterval):
+		}
+	}
+}
+
+func (m *Migrator) releaseAdvisoryLock(ctx context.Context) error {
+	_, err := m.conn.Exec(ctx, "select pg_advisory_unlock($1)", m.advisoryLockKey())
+	return err
+}
+
+func (m *Migrator) ensureSchemaVersionTableExists(ctx context.Context) error {
+	_, err := m.conn.Exec(ctx, fmt.Sprintf(`
+		create table if not exists %s(version int4 not null)
+	`, m.versionTable))
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	err = m.conn.QueryRow(ctx, "select count(*) from "+m.versionTable).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		_, err = m.conn.Exec(ctx, "insert into "+m.versionTable+"(version) values(0)")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,10 +2,13 @@ package migrate_test
 
 import (
 	"context"
+	"embed"
 	"fmt"
 	"os"
 	"os/exec"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
@@ -14,6 +17,9 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+//go:embed testdata/fsembed
+var fsEmbedMigrations embed.FS
+
 var versionTable string = "schema_version_non_default"
 
 func connectConn(t testing.TB) *pgx.Conn {
@@ -68,6 +74,17 @@ func tableExists(t testing.TB, conn *pgx.Conn, tableName string) bool {
 	return exists
 }
 
+func schemaExists(t testing.TB, conn *pgx.Conn, schemaName string) bool {
+	var exists bool
+	err := conn.QueryRow(
+		context.Background(),
+		"select exists(select 1 from information_schema.schemata where schema_name=$1)",
+		schemaName,
+	).Scan(&exists)
+	assert.NoError(t, err)
+	return exists
+}
+
 func createEmptyMigrator(t testing.TB, conn *pgx.Conn) *migrate.Migrator {
 	var err error
 	m, err := migrate.NewMigrator(context.Background(), conn, versionTable)
@@ -118,6 +135,22 @@ func TestAppendMigration(t *testing.T) {
 	assert.Equal(t, m.Migrations[0].SQL, upSQL)
 }
 
+func TestAppendMigrationEx(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createEmptyMigrator(t, conn)
+
+	name := "Create t"
+	upSQL := "create table t(id serial primary key);"
+	downSQL := "drop table t;"
+	m.AppendMigrationEx(name, upSQL, downSQL)
+
+	assert.Len(t, m.Migrations, 1)
+	assert.Equal(t, m.Migrations[0].Name, name)
+	assert.Equal(t, m.Migrations[0].SQL, upSQL)
+	assert.Equal(t, m.Migrations[0].DownSQL, downSQL)
+}
+
 func TestLoadMigrationsMissingDirectory(t *testing.T) {
 	conn := connectConn(t)
 	defer conn.Close(context.Background())
@@ -188,6 +221,226 @@ func TestLoadMigrationsNoForward(t *testing.T) {
 	require.Equal(t, migrate.ErrNoFwMigration, err)
 }
 
+func TestLoadMigrationsWithDownSQL(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createEmptyMigrator(t, conn)
+
+	err := m.LoadMigrations("testdata/reversible")
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 1)
+
+	assert.Equal(t, "create table rev_t1(id serial primary key);", m.Migrations[0].SQL)
+	assert.Equal(t, "drop table rev_t1;", m.Migrations[0].DownSQL)
+}
+
+func TestMigrateToDownMigrations(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createEmptyMigrator(t, conn)
+	m.AppendMigrationEx("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigrationEx("Create t2", "create table t2(id serial);", "drop table t2;")
+	m.AppendMigrationEx("Create t3", "create table t3(id serial);", "drop table t3;")
+
+	err := m.MigrateTo(context.Background(), 3)
+	require.NoError(t, err)
+
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, currentVersion(t, conn))
+	assert.True(t, tableExists(t, conn, "t1"))
+	assert.False(t, tableExists(t, conn, "t2"))
+	assert.False(t, tableExists(t, conn, "t3"))
+
+	err = m.MigrateTo(context.Background(), 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, currentVersion(t, conn))
+	assert.False(t, tableExists(t, conn, "t1"))
+}
+
+func TestMigrateToIrreversibleMigration(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createSampleMigrator(t, conn)
+
+	err := m.MigrateTo(context.Background(), 3)
+	require.NoError(t, err)
+
+	err = m.MigrateTo(context.Background(), 0)
+	require.Equal(t, migrate.ErrIrreversibleMigration, err)
+}
+
+func TestLoadSourceMemorySource(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createEmptyMigrator(t, conn)
+
+	var source migrate.MemorySource
+	source.Append("001_create_t1.sql", "create table t1(id serial primary key);", "drop table t1;")
+	source.Append("002_create_t2.sql", "create table t2(id serial primary key);", "")
+
+	err := m.LoadSource(context.Background(), &source)
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 2)
+	assert.Equal(t, "001_create_t1.sql", m.Migrations[0].Name)
+	assert.Equal(t, "drop table t1;", m.Migrations[0].DownSQL)
+	assert.Equal(t, "002_create_t2.sql", m.Migrations[1].Name)
+	assert.Equal(t, "", m.Migrations[1].DownSQL)
+}
+
+func TestLoadSourceFSSource(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createEmptyMigrator(t, conn)
+
+	err := m.LoadSource(context.Background(), migrate.FSSource(fsEmbedMigrations, "testdata/fsembed"))
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 1)
+	assert.Equal(t, "001_create_embed_t1.sql", m.Migrations[0].Name)
+	assert.Equal(t, "create table embed_t1(id serial primary key);", m.Migrations[0].SQL)
+}
+
+func TestPlan(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createSampleMigrator(t, conn)
+
+	steps, err := m.Plan(context.Background(), 2)
+	require.NoError(t, err)
+	require.Len(t, steps, 2)
+	assert.EqualValues(t, 1, steps[0].Version)
+	assert.Equal(t, migrate.DirectionUp, steps[0].Direction)
+	assert.Equal(t, "create table t1(id serial);", steps[0].SQL)
+	assert.EqualValues(t, 2, steps[1].Version)
+
+	// Plan does not touch the database.
+	assert.EqualValues(t, 0, currentVersion(t, conn))
+}
+
+func TestRenderSQL(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createEmptyMigrator(t, conn)
+	m.Data = map[string]interface{}{"prefix": "foo"}
+	m.AppendMigration("Create t", "create table {{.prefix}}_t(id serial);")
+
+	sql, err := m.RenderSQL(1)
+	require.NoError(t, err)
+	assert.Equal(t, "create table foo_t(id serial);", sql)
+}
+
+func TestMigrateToDryRun(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{DryRun: true})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);")
+
+	var onStartCallCount int
+	m.OnStart = func(_ int32, _, _ string) {
+		onStartCallCount++
+	}
+
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, onStartCallCount)
+	assert.EqualValues(t, 0, currentVersion(t, conn))
+	assert.False(t, tableExists(t, conn, "t1"))
+}
+
+func TestLoadMigrationsParsesHookDirectives(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createEmptyMigrator(t, conn)
+
+	err := m.LoadMigrations("testdata/hooks")
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 1)
+	assert.Len(t, m.Migrations[0].PreHooks, 1)
+	assert.NotContains(t, m.Migrations[0].SQL, "tern:pre")
+}
+
+func TestMigrateRunsHooks(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createEmptyMigrator(t, conn)
+
+	var hookCalled bool
+	m.Migrations = append(m.Migrations, &migrate.Migration{
+		Sequence: 1,
+		Name:     "Create t1 in a fresh schema",
+		SQL:      "create table tern_hook_test.t1(id serial primary key);",
+		PreHooks: []migrate.Hook{migrate.CreateSchemaHook("tern_hook_test")},
+		PostHooks: []migrate.Hook{func(ctx context.Context, conn *pgx.Conn) error {
+			hookCalled = true
+			return nil
+		}},
+	})
+
+	err := m.Migrate(context.Background())
+	require.NoError(t, err)
+	assert.True(t, hookCalled)
+	assert.True(t, tableExists(t, conn, "t1"))
+}
+
+func TestMigrateToDryRunSkipsHooks(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{DryRun: true})
+	require.NoError(t, err)
+
+	var preHookCalled, postHookCalled bool
+	m.Migrations = append(m.Migrations, &migrate.Migration{
+		Sequence: 1,
+		Name:     "Create t1",
+		SQL:      "create table t1(id serial primary key);",
+		PreHooks: []migrate.Hook{func(ctx context.Context, conn *pgx.Conn) error {
+			preHookCalled = true
+			return migrate.CreateSchemaHook("tern_hook_test")(ctx, conn)
+		}},
+		PostHooks: []migrate.Hook{func(ctx context.Context, conn *pgx.Conn) error {
+			postHookCalled = true
+			return nil
+		}},
+	})
+
+	err = m.Migrate(context.Background())
+	require.NoError(t, err)
+	assert.False(t, preHookCalled)
+	assert.False(t, postHookCalled)
+	assert.EqualValues(t, 0, currentVersion(t, conn))
+	assert.False(t, schemaExists(t, conn, "tern_hook_test"))
+}
+
+func TestMigrateToDownMigrationsDoesNotRerunHooks(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createEmptyMigrator(t, conn)
+
+	var preHookCallCount int
+	m.Migrations = append(m.Migrations, &migrate.Migration{
+		Sequence: 1,
+		Name:     "Create t1 in a fresh schema",
+		SQL:      "create table tern_hook_test.t1(id serial primary key);",
+		DownSQL:  "drop table tern_hook_test.t1;",
+		PreHooks: []migrate.Hook{func(ctx context.Context, conn *pgx.Conn) error {
+			preHookCallCount++
+			return migrate.CreateSchemaHook("tern_hook_test")(ctx, conn)
+		}},
+	})
+
+	err := m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, preHookCallCount)
+
+	err = m.MigrateTo(context.Background(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, preHookCallCount)
+	assert.EqualValues(t, 0, currentVersion(t, conn))
+}
+
 func TestMigrate(t *testing.T) {
 	conn := connectConn(t)
 	defer conn.Close(context.Background())
@@ -284,6 +537,46 @@ func TestMigrateToDisableTx(t *testing.T) {
 	require.False(t, tableExists(t, conn, "t3"))
 }
 
+func TestMigrateConcurrentLocking(t *testing.T) {
+	connectConn(t).Close(context.Background())
+	connString := os.Getenv("MIGRATE_TEST_CONN_STRING")
+
+	conn1, err := pgx.Connect(context.Background(), connString)
+	require.NoError(t, err)
+	defer conn1.Close(context.Background())
+
+	conn2, err := pgx.Connect(context.Background(), connString)
+	require.NoError(t, err)
+	defer conn2.Close(context.Background())
+
+	m1, err := migrate.NewMigrator(context.Background(), conn1, versionTable)
+	require.NoError(t, err)
+	m1.AppendMigration("Create t1", "create table t1(id serial);")
+
+	m2, err := migrate.NewMigratorEx(context.Background(), conn2, versionTable, &migrate.MigratorOptions{LockTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	m2.AppendMigration("Create t1", "create table t1(id serial);")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs[0] = m1.Migrate(context.Background())
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = m2.Migrate(context.Background())
+	}()
+	wg.Wait()
+
+	// The advisory lock serializes the two migrators, so exactly one of
+	// them creates t1 and the other observes it already at version 1.
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	assert.EqualValues(t, 1, currentVersion(t, conn1))
+}
+
 // // https://github.com/jackc/tern/issues/18
 func TestNotCreatingVersionTableIfAlreadyVisibleInSearchPath(t *testing.T) {
 	conn := connectConn(t)
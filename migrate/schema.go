@@ -0,0 +1,293 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// schemaLineSeparator joins a schema object's identity (kind + name) to
+// its definition within a single dumped line, so the two halves can be
+// recovered when diffing two dumps.
+const schemaLineSeparator = "\t"
+
+// SchemaDiff is the structured result of comparing two schema dumps
+// produced by DumpSchema.
+type SchemaDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// IsEmpty reports whether the diff contains no differences.
+func (d SchemaDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// DumpSchema returns a stable, sorted textual representation of conn's
+// tables, columns, indexes, constraints, sequences, and functions. Two
+// dumps of an identical schema always produce identical text, making
+// the result suitable for diffing and for storing alongside migrations.
+func DumpSchema(ctx context.Context, conn *pgx.Conn) (string, error) {
+	dumpers := []func(context.Context, *pgx.Conn) ([]string, error){
+		dumpTables,
+		dumpColumns,
+		dumpIndexes,
+		dumpConstraints,
+		dumpSequences,
+		dumpFunctions,
+	}
+
+	var lines []string
+	for _, dump := range dumpers {
+		l, err := dump(ctx, conn)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, l...)
+	}
+
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+func dumpTables(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	rows, err := conn.Query(ctx, `
+		select table_schema, table_name, table_type
+		from information_schema.tables
+		where table_schema not in ('pg_catalog', 'information_schema')
+		order by table_schema, table_name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var schema, table, typ string
+		if err := rows.Scan(&schema, &table, &typ); err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("table|%s.%s", schema, table)
+		lines = append(lines, key+schemaLineSeparator+typ)
+	}
+	return lines, rows.Err()
+}
+
+func dumpColumns(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	rows, err := conn.Query(ctx, `
+		select table_schema, table_name, column_name, data_type, is_nullable, coalesce(column_default, '')
+		from information_schema.columns
+		where table_schema not in ('pg_catalog', 'information_schema')
+		order by table_schema, table_name, ordinal_position
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var schema, table, column, dataType, nullable, def string
+		if err := rows.Scan(&schema, &table, &column, &dataType, &nullable, &def); err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("column|%s.%s.%s", schema, table, column)
+		lines = append(lines, key+schemaLineSeparator+fmt.Sprintf("%s null=%s default=%s", dataType, nullable, def))
+	}
+	return lines, rows.Err()
+}
+
+func dumpIndexes(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	rows, err := conn.Query(ctx, `
+		select schemaname, tablename, indexname, indexdef
+		from pg_indexes
+		where schemaname not in ('pg_catalog', 'information_schema')
+		order by schemaname, tablename, indexname
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var schema, table, name, def string
+		if err := rows.Scan(&schema, &table, &name, &def); err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("index|%s.%s.%s", schema, table, name)
+		lines = append(lines, key+schemaLineSeparator+def)
+	}
+	return lines, rows.Err()
+}
+
+func dumpConstraints(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	rows, err := conn.Query(ctx, `
+		select tc.table_schema, tc.table_name, tc.constraint_name, tc.constraint_type
+		from information_schema.table_constraints tc
+		where tc.table_schema not in ('pg_catalog', 'information_schema')
+		order by tc.table_schema, tc.table_name, tc.constraint_name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var schema, table, name, typ string
+		if err := rows.Scan(&schema, &table, &name, &typ); err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("constraint|%s.%s.%s", schema, table, name)
+		lines = append(lines, key+schemaLineSeparator+typ)
+	}
+	return lines, rows.Err()
+}
+
+func dumpSequences(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	rows, err := conn.Query(ctx, `
+		select sequence_schema, sequence_name, data_type
+		from information_schema.sequences
+		where sequence_schema not in ('pg_catalog', 'information_schema')
+		order by sequence_schema, sequence_name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var schema, name, dataType string
+		if err := rows.Scan(&schema, &name, &dataType); err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("sequence|%s.%s", schema, name)
+		lines = append(lines, key+schemaLineSeparator+dataType)
+	}
+	return lines, rows.Err()
+}
+
+func dumpFunctions(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	rows, err := conn.Query(ctx, `
+		select routine_schema, routine_name, coalesce(routine_definition, '')
+		from information_schema.routines
+		where routine_schema not in ('pg_catalog', 'information_schema')
+		order by routine_schema, routine_name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var schema, name, def string
+		if err := rows.Scan(&schema, &name, &def); err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("function|%s.%s", schema, name)
+		lines = append(lines, key+schemaLineSeparator+def)
+	}
+	return lines, rows.Err()
+}
+
+// diffSchema compares two DumpSchema outputs, matching objects by their
+// kind+name key so that a modified object is reported as Changed rather
+// than as an unrelated Added/Removed pair.
+func diffSchema(want, got string) SchemaDiff {
+	wantObjs := parseSchemaDump(want)
+	gotObjs := parseSchemaDump(got)
+
+	var diff SchemaDiff
+	for key, def := range gotObjs {
+		wantDef, ok := wantObjs[key]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, key)
+		case wantDef != def:
+			diff.Changed = append(diff.Changed, key)
+		}
+	}
+	for key := range wantObjs {
+		if _, ok := gotObjs[key]; !ok {
+			diff.Removed = append(diff.Removed, key)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+
+	return diff
+}
+
+func parseSchemaDump(dump string) map[string]string {
+	objs := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimRight(dump, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		idx := strings.Index(line, schemaLineSeparator)
+		if idx < 0 {
+			continue
+		}
+		objs[line[:idx]] = line[idx+len(schemaLineSeparator):]
+	}
+	return objs
+}
+
+// snapshotPath returns the path schema snapshots for version are read
+// from and written to within m.SnapshotDir.
+func (m *Migrator) snapshotPath(version int32) string {
+	return filepath.Join(m.SnapshotDir, fmt.Sprintf("%03d.sql", version))
+}
+
+// writeSnapshot dumps the live schema and stores it as version's
+// snapshot. It is a no-op when m.SnapshotDir is empty.
+func (m *Migrator) writeSnapshot(ctx context.Context, version int32) error {
+	if m.SnapshotDir == "" {
+		return nil
+	}
+
+	dump, err := DumpSchema(ctx, m.conn)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.SnapshotDir, 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(m.snapshotPath(version), []byte(dump), 0644)
+}
+
+// VerifySnapshot re-dumps the live schema and diffs it against the
+// snapshot stored for version, returning what has drifted. It requires
+// m.SnapshotDir to be set and a snapshot to already exist for version.
+func (m *Migrator) VerifySnapshot(ctx context.Context, version int32) (SchemaDiff, error) {
+	if m.SnapshotDir == "" {
+		return SchemaDiff{}, fmt.Errorf("migrate: SnapshotDir is not set")
+	}
+
+	want, err := ioutil.ReadFile(m.snapshotPath(version))
+	if err != nil {
+		return SchemaDiff{}, err
+	}
+
+	got, err := DumpSchema(ctx, m.conn)
+	if err != nil {
+		return SchemaDiff{}, err
+	}
+
+	return diffSchema(string(want), got), nil
+}
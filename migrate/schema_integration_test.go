@@ -0,0 +1,77 @@
+package migrate_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/tern/migrate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpSchemaIncludesLiveObjects(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	mustExec(t, conn, "create table t1(id serial primary key, name text not null)")
+	mustExec(t, conn, "create index t1_name_idx on t1(name)")
+	mustExec(t, conn, "create sequence s1")
+	mustExec(t, conn, "create function f1() returns int as $$ select 1 $$ language sql")
+
+	dump, err := migrate.DumpSchema(context.Background(), conn)
+	require.NoError(t, err)
+
+	schemaName := currentSchema(t, conn)
+	assert.Contains(t, dump, "table|"+schemaName+".t1")
+	assert.Contains(t, dump, "column|"+schemaName+".t1.name")
+	assert.Contains(t, dump, "index|"+schemaName+".t1.t1_name_idx")
+	assert.Contains(t, dump, "sequence|"+schemaName+".s1")
+	assert.Contains(t, dump, "function|"+schemaName+".f1")
+}
+
+func TestDumpSchemaTableWithNoColumns(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	mustExec(t, conn, "create table empty_t()")
+
+	dump, err := migrate.DumpSchema(context.Background(), conn)
+	require.NoError(t, err)
+
+	schemaName := currentSchema(t, conn)
+	assert.Contains(t, dump, "table|"+schemaName+".empty_t")
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m := createEmptyMigrator(t, conn)
+	m.SnapshotDir = t.TempDir()
+	m.AppendMigration("Create t1", "create table t1(id serial primary key);")
+
+	err := m.Migrate(context.Background())
+	require.NoError(t, err)
+
+	diff, err := m.VerifySnapshot(context.Background(), 1)
+	require.NoError(t, err)
+	assert.True(t, diff.IsEmpty())
+
+	mustExec(t, conn, "alter table t1 add column name text")
+
+	diff, err = m.VerifySnapshot(context.Background(), 1)
+	require.NoError(t, err)
+	assert.False(t, diff.IsEmpty())
+	assert.Contains(t, diff.Added, "column|"+currentSchema(t, conn)+".t1.name")
+}
+
+// currentSchema returns the schema unqualified objects are created in.
+// connectConn drops the schema named after the current user, so this is
+// normally public.
+func currentSchema(t testing.TB, conn *pgx.Conn) string {
+	var currentSchema string
+	err := conn.QueryRow(context.Background(), "select current_schema()").Scan(&currentSchema)
+	assert.NoError(t, err)
+	return currentSchema
+}
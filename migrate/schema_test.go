@@ -0,0 +1,28 @@
+package migrate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffSchema(t *testing.T) {
+	want := "column|public.t1.id\tinteger null=NO default=\n" +
+		"table|public.t1\t\n"
+	got := "column|public.t1.id\ttext null=NO default=\n" +
+		"table|public.t2\t\n"
+
+	diff := diffSchema(want, got)
+
+	assert.Equal(t, []string{"table|public.t2"}, diff.Added)
+	assert.Equal(t, []string{"table|public.t1"}, diff.Removed)
+	assert.Equal(t, []string{"column|public.t1.id"}, diff.Changed)
+}
+
+func TestDiffSchemaNoChanges(t *testing.T) {
+	dump := "column|public.t1.id\tinteger null=NO default=\n"
+
+	diff := diffSchema(dump, dump)
+
+	assert.True(t, diff.IsEmpty())
+}
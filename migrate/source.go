@@ -0,0 +1,181 @@
+package migrate
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Source supplies migrations to a Migrator. Implementations let
+// migrations be loaded from a directory on disk (DirSource), an
+// fs.FS such as an embed.FS (FSSource), or an in-memory list built up
+// in tests (MemorySource).
+type Source interface {
+	// List returns the sorted list of available migration versions.
+	List() ([]int32, error)
+
+	// Open returns the name and up/down SQL for the given migration
+	// version.
+	Open(version int32) (name, up, down string, err error)
+}
+
+type dirSource struct {
+	path string
+}
+
+// DirSource returns a Source that loads migrations from the directory
+// at path, the same layout LoadMigrations has always read.
+func DirSource(path string) Source {
+	return &dirSource{path: path}
+}
+
+func (s *dirSource) List() ([]int32, error) {
+	fileNames, err := FindMigrations(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]int32, len(fileNames))
+	for i := range fileNames {
+		versions[i] = int32(i) + 1
+	}
+	return versions, nil
+}
+
+func (s *dirSource) Open(version int32) (name, up, down string, err error) {
+	fileNames, err := FindMigrations(s.path)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if version < 1 || int(version) > len(fileNames) {
+		return "", "", "", fmt.Errorf("no migration with version %d", version)
+	}
+
+	name = fileNames[version-1]
+	contents, err := ioutil.ReadFile(filepath.Join(s.path, name))
+	if err != nil {
+		return "", "", "", err
+	}
+
+	up, down = splitMigrationSQL(string(contents))
+	return name, strings.TrimSpace(up), strings.TrimSpace(down), nil
+}
+
+type fsSource struct {
+	fsys fs.FS
+	root string
+}
+
+// FSSource returns a Source that loads migrations from root within
+// fsys. Passing an embed.FS allows shipping migrations compiled into a
+// single binary.
+func FSSource(fsys fs.FS, root string) Source {
+	return &fsSource{fsys: fsys, root: root}
+}
+
+func (s *fsSource) fileNames() ([]string, error) {
+	entries, err := fs.ReadDir(s.fsys, s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if migrationPattern.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		matches := migrationPattern.FindStringSubmatch(name)
+		n, err := strconv.ParseInt(matches[1], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		if int(n) < i+1 {
+			return nil, fmt.Errorf("Duplicate migration %d", n)
+		} else if int(n) > i+1 {
+			return nil, fmt.Errorf("Missing migration %d", i+1)
+		}
+	}
+
+	return names, nil
+}
+
+func (s *fsSource) List() ([]int32, error) {
+	names, err := s.fileNames()
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]int32, len(names))
+	for i := range names {
+		versions[i] = int32(i) + 1
+	}
+	return versions, nil
+}
+
+func (s *fsSource) Open(version int32) (name, up, down string, err error) {
+	names, err := s.fileNames()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if version < 1 || int(version) > len(names) {
+		return "", "", "", fmt.Errorf("no migration with version %d", version)
+	}
+
+	name = names[version-1]
+	contents, err := fs.ReadFile(s.fsys, path.Join(s.root, name))
+	if err != nil {
+		return "", "", "", err
+	}
+
+	up, down = splitMigrationSQL(string(contents))
+	return name, strings.TrimSpace(up), strings.TrimSpace(down), nil
+}
+
+// memoryMigration is a single migration held in a MemorySource.
+type memoryMigration struct {
+	name, up, down string
+}
+
+// MemorySource is a Source backed by an in-memory list of migrations,
+// useful for constructing migrations in tests without touching disk.
+type MemorySource struct {
+	migrations []memoryMigration
+}
+
+// Append adds a migration with the given name, up SQL, and down SQL to
+// the source.
+func (s *MemorySource) Append(name, up, down string) {
+	s.migrations = append(s.migrations, memoryMigration{name: name, up: up, down: down})
+}
+
+func (s *MemorySource) List() ([]int32, error) {
+	versions := make([]int32, len(s.migrations))
+	for i := range s.migrations {
+		versions[i] = int32(i) + 1
+	}
+	return versions, nil
+}
+
+func (s *MemorySource) Open(version int32) (name, up, down string, err error) {
+	if version < 1 || int(version) > len(s.migrations) {
+		return "", "", "", fmt.Errorf("no migration with version %d", version)
+	}
+
+	mig := s.migrations[version-1]
+	return mig.name, mig.up, mig.down, nil
+}